@@ -2,13 +2,47 @@
 
 set -e
 
-# Initialize LOG_FILE with a default value
-LOG_FILE="/var/log/riverrun_setup.log"
+# Setup keeps its own plain-text log, apart from the converter's LOG_FILE
+SETUP_LOG_FILE="/var/log/riverrun_setup.log"
 
 # Load variables from the configuration file
-CONFIG_FILE="/etc/riverrun_config.toml"
+CONFIG_FILE="${RIVERRUN_CONFIG:-/etc/riverrun_config.toml}"
 REPO_CONFIG_FILE="riverrun/riverrun_config.toml"
 
+usage() {
+  echo "Usage: $0 [-c config_file] [-s SETTING=value]... [config_file]"
+  echo "Settings are read from the config file, then RIVERRUN_<SETTING> environment"
+  echo "variables, then -s flags, with later sources taking precedence."
+}
+
+# Parse command line flags
+FLAG_SETTINGS=()
+while getopts "c:s:h" opt; do
+  case "$opt" in
+    c) CONFIG_FILE="$OPTARG" ;;
+    s)
+      if ! [[ "$OPTARG" =~ ^[A-Z_][A-Z0-9_]*= ]]; then
+        echo "Error: -s expects SETTING=value, got '$OPTARG'."
+        exit 1
+      fi
+      FLAG_SETTINGS+=("$OPTARG")
+      ;;
+    h)
+      usage
+      exit 0
+      ;;
+    *)
+      usage
+      exit 1
+      ;;
+  esac
+done
+shift $((OPTIND - 1))
+# A positional config file path is still accepted for backward compatibility
+if [ -n "$1" ]; then
+  CONFIG_FILE="$1"
+fi
+
 # Ensure the script runs as root
 if [ "$(id -u)" -ne 0 ]; then
   echo "This script must be run as root."
@@ -17,40 +51,241 @@ fi
 
 # Check if the configuration file exists in /etc, and copy it from the repo if not
 if [ ! -f "$CONFIG_FILE" ]; then
-  echo "Configuration file not found at $CONFIG_FILE. Copying default configuration from the repository." | tee -a "$LOG_FILE"
+  echo "Configuration file not found at $CONFIG_FILE. Copying default configuration from the repository." | tee -a "$SETUP_LOG_FILE"
   if [ -f "$REPO_CONFIG_FILE" ]; then
     cp "$REPO_CONFIG_FILE" "$CONFIG_FILE"
-    echo "Default configuration copied to $CONFIG_FILE. Please edit it before proceeding." | tee -a "$LOG_FILE"
+    echo "Default configuration copied to $CONFIG_FILE. Please edit it before proceeding." | tee -a "$SETUP_LOG_FILE"
     exit 0
   else
-    echo "Default configuration file not found in the repository at $REPO_CONFIG_FILE." | tee -a "$LOG_FILE"
+    echo "Default configuration file not found in the repository at $REPO_CONFIG_FILE." | tee -a "$SETUP_LOG_FILE"
     exit 1
   fi
 fi
 
-# Source the configuration file
-source <(grep -v '^#' "$CONFIG_FILE" | sed 's/ = /=/g')
+# Print every problem collected in config_errors and exit, if there are any
+check_config_errors() {
+  if [ ${#config_errors[@]} -gt 0 ]; then
+    echo "Error: Found ${#config_errors[@]} problem(s) in $CONFIG_FILE:" | tee -a "$SETUP_LOG_FILE"
+    for error in "${config_errors[@]}"; do
+      echo "  - $error" | tee -a "$SETUP_LOG_FILE"
+    done
+    echo "Please update $CONFIG_FILE and try again." | tee -a "$SETUP_LOG_FILE"
+    exit 1
+  fi
+}
 
-# Validate required variables
+# Check that every setting line can be sourced by bash, reporting bad lines by number.
+# Values are double- or single-quoted strings, numbers or true/false, optionally with
+# spaces around the = and a trailing comment.
+CONFIG_LINE_PATTERN="^[[:space:]]*[A-Z_][A-Z0-9_]*[[:space:]]*=[[:space:]]*(\"[^\"]*\"|'[^']*'|-?[0-9]+(\\.[0-9]+)?|true|false)[[:space:]]*(#.*)?\$"
+config_errors=()
+line_number=0
+while IFS= read -r line || [ -n "$line" ]; do
+  line_number=$((line_number + 1))
+  if [[ -z "${line//[[:space:]]/}" || "$line" =~ ^[[:space:]]*# ]]; then
+    continue
+  fi
+  if ! [[ "$line" =~ $CONFIG_LINE_PATTERN ]]; then
+    config_errors+=("line $line_number: expected KEY = \"value\", KEY = number or KEY = true/false, got: $line")
+  fi
+done < "$CONFIG_FILE"
+# A line bash can't run would abort the source below under set -e, so report bad lines first
+check_config_errors
+
+# Source the configuration file, dropping the spaces around each line's first =
+source <(grep -v '^[[:space:]]*#' "$CONFIG_FILE" | sed -E 's/^[[:space:]]*([A-Z_][A-Z0-9_]*)[[:space:]]*=[[:space:]]*/\1=/')
+
+# Every setting riverrun reads. Overrides may only set these, so they can't clobber
+# shell variables such as PATH or IFS.
 REQUIRED_VARS=("ICECAST_CONF" "SOURCE_PASSWORD_FILE" "RELAY_PASSWORD_FILE" "ADMIN_PASSWORD_FILE" "MUSIC_DIR" "UPLOAD_DIR" "M3U_FILE" "SUBMIT_USER" "SUPPORTED_FORMATS" "BITRATE" "SAMPLE_RATE" "AUDIO_CODEC" "CONVERTER_SCRIPT" "LOG_FILE" "ICECAST_LOCATION" "ICECAST_ADMIN_EMAIL" "ICECAST_MAX_CLIENTS" "ICECAST_MAX_SOURCES" "ICECAST_HOSTNAME" "ICECAST_STREAM_NAME" "ICECAST_STREAM_GENRE" "ICECAST_STREAM_DESCRIPTION" "ICECAST_STREAM_URL")
+OPTIONAL_VARS=(
+  "QUARANTINE_DIR" "LOG_MAX_SIZE_KB" "LOG_RETAIN" "AUDIO_STREAM_INDEX" "PARTIAL_FILE_PATTERNS"
+  "TARGET_SIZE_KB" "MIN_BITRATE_KBPS" "MAX_BITRATE_KBPS" "TAG_PROVENANCE" "AUDIO_CHANNELS" "MAX_LIBRARY_MB"
+  "MAX_LIBRARY_FILES" "MAX_LIBRARY_AGE_DAYS" "MIN_FREE_DISK_MB" "ATTEMPT_REPAIR" "CONVERTER_WORKERS"
+  "UPLOAD_POLL_INTERVAL_SEC" "UPLOAD_STABLE_POLLS" "ICECAST_PORT" "ICECAST_BIND_ADDRESS" "LOG_LEVEL"
+  "LOG_FORMAT" "STATE_DIR" "FAILED_DIR" "OUTPUT_EXTENSION" "MAX_CONVERSION_ATTEMPTS" "RETRY_BASE_DELAY_SEC"
+  "NORMALIZE_LOUDNESS" "LOUDNESS_TARGET_LUFS" "WRITE_REPLAYGAIN" "TRIM_SILENCE" "M3U_EXTENDED"
+  "LOSSLESS_PASSTHROUGH" "KEEP_COVER_ART" "DUPLICATE_UPLOADS" "SILENCE_THRESHOLD_DB"
+  "SILENCE_MIN_DURATION_SEC"
+)
+
+# Succeed if the name is a riverrun setting
+is_setting() {
+  local var
+  for var in "${REQUIRED_VARS[@]}" "${OPTIONAL_VARS[@]}"; do
+    if [ "$var" = "$1" ]; then
+      return 0
+    fi
+  done
+  return 1
+}
+
+# Apply overrides from RIVERRUN_<SETTING> environment variables, then from -s flags
+for env_var in $(compgen -v RIVERRUN_); do
+  if [ "$env_var" = "RIVERRUN_CONFIG" ]; then
+    continue
+  fi
+  if is_setting "${env_var#RIVERRUN_}"; then
+    declare "${env_var#RIVERRUN_}=${!env_var}"
+  else
+    config_errors+=("$env_var: ${env_var#RIVERRUN_} is not a riverrun setting")
+  fi
+done
+for setting in "${FLAG_SETTINGS[@]}"; do
+  if is_setting "${setting%%=*}"; then
+    declare "${setting%%=*}=${setting#*=}"
+  else
+    config_errors+=("-s $setting: ${setting%%=*} is not a riverrun setting")
+  fi
+done
+
+# Apply defaults for optional variables
+QUARANTINE_DIR="${QUARANTINE_DIR:-/home/$SUBMIT_USER/quarantine}"
+LOG_MAX_SIZE_KB="${LOG_MAX_SIZE_KB:-10240}"
+LOG_RETAIN="${LOG_RETAIN:-5}"
+AUDIO_STREAM_INDEX="${AUDIO_STREAM_INDEX:-0}"
+PARTIAL_FILE_PATTERNS="${PARTIAL_FILE_PATTERNS-*.part *.filepart *.tmp}"
+TARGET_SIZE_KB="${TARGET_SIZE_KB:-0}"
+MIN_BITRATE_KBPS="${MIN_BITRATE_KBPS:-48}"
+MAX_BITRATE_KBPS="${MAX_BITRATE_KBPS:-320}"
+TAG_PROVENANCE="${TAG_PROVENANCE:-false}"
+AUDIO_CHANNELS="${AUDIO_CHANNELS:-0}"
+MAX_LIBRARY_MB="${MAX_LIBRARY_MB:-0}"
+MAX_LIBRARY_FILES="${MAX_LIBRARY_FILES:-0}"
+MAX_LIBRARY_AGE_DAYS="${MAX_LIBRARY_AGE_DAYS:-0}"
+MIN_FREE_DISK_MB="${MIN_FREE_DISK_MB:-512}"
+ATTEMPT_REPAIR="${ATTEMPT_REPAIR:-false}"
+CONVERTER_WORKERS="${CONVERTER_WORKERS:-1}"
+UPLOAD_POLL_INTERVAL_SEC="${UPLOAD_POLL_INTERVAL_SEC:-2}"
+UPLOAD_STABLE_POLLS="${UPLOAD_STABLE_POLLS:-2}"
+ICECAST_PORT="${ICECAST_PORT:-8000}"
+ICECAST_BIND_ADDRESS="${ICECAST_BIND_ADDRESS:-0.0.0.0}"
+LOG_LEVEL="${LOG_LEVEL:-info}"
+LOG_FORMAT="${LOG_FORMAT:-text}"
+STATE_DIR="${STATE_DIR:-/home/$SUBMIT_USER/.riverrun}"
+FAILED_DIR="${FAILED_DIR:-/home/$SUBMIT_USER/failed}"
+OUTPUT_EXTENSION="${OUTPUT_EXTENSION:-.ogg}"
+MAX_CONVERSION_ATTEMPTS="${MAX_CONVERSION_ATTEMPTS:-3}"
+RETRY_BASE_DELAY_SEC="${RETRY_BASE_DELAY_SEC:-60}"
+NORMALIZE_LOUDNESS="${NORMALIZE_LOUDNESS:-false}"
+LOUDNESS_TARGET_LUFS="${LOUDNESS_TARGET_LUFS:--16}"
+WRITE_REPLAYGAIN="${WRITE_REPLAYGAIN:-false}"
+TRIM_SILENCE="${TRIM_SILENCE:-false}"
+M3U_EXTENDED="${M3U_EXTENDED:-false}"
+LOSSLESS_PASSTHROUGH="${LOSSLESS_PASSTHROUGH:-true}"
+KEEP_COVER_ART="${KEEP_COVER_ART:-false}"
+DUPLICATE_UPLOADS="${DUPLICATE_UPLOADS:-allow}"
+SILENCE_THRESHOLD_DB="${SILENCE_THRESHOLD_DB:--50}"
+SILENCE_MIN_DURATION_SEC="${SILENCE_MIN_DURATION_SEC:-0.5}"
+
+# Create the converter's log directory, remembering whether setup made it so it can be
+# handed to the submit user later
+LOG_DIR="$(dirname "$LOG_FILE")"
+LOG_DIR_CREATED=false
+if [ ! -d "$LOG_DIR" ]; then
+  mkdir -p "$LOG_DIR"
+  LOG_DIR_CREATED=true
+fi
+
+# Validate settings, collecting every problem before giving up
 for var in "${REQUIRED_VARS[@]}"; do
   if [ -z "${!var}" ]; then
-    echo "Error: Required variable $var is not defined in the configuration file. Please update $CONFIG_FILE and try again." | tee -a "$LOG_FILE"
-    exit 1
+    config_errors+=("$var is required but not defined")
   fi
 done
 
+POSITIVE_VARS=("ICECAST_MAX_CLIENTS" "ICECAST_MAX_SOURCES" "SAMPLE_RATE" "CONVERTER_WORKERS" "UPLOAD_POLL_INTERVAL_SEC" "UPLOAD_STABLE_POLLS" "MIN_BITRATE_KBPS" "MAX_BITRATE_KBPS" "MAX_CONVERSION_ATTEMPTS")
+for var in "${POSITIVE_VARS[@]}"; do
+  if [ -n "${!var}" ] && ! [[ "${!var}" =~ ^[0-9]+$ && "${!var}" -gt 0 ]]; then
+    config_errors+=("$var must be a positive whole number, got '${!var}'")
+  fi
+done
+
+NON_NEGATIVE_VARS=("LOG_MAX_SIZE_KB" "LOG_RETAIN" "AUDIO_STREAM_INDEX" "AUDIO_CHANNELS" "TARGET_SIZE_KB" "MAX_LIBRARY_MB" "MAX_LIBRARY_FILES" "MAX_LIBRARY_AGE_DAYS" "MIN_FREE_DISK_MB" "RETRY_BASE_DELAY_SEC")
+for var in "${NON_NEGATIVE_VARS[@]}"; do
+  if ! [[ "${!var}" =~ ^[0-9]+$ ]]; then
+    config_errors+=("$var must be zero or a positive whole number, got '${!var}'")
+  fi
+done
+
+BOOLEAN_VARS=("TAG_PROVENANCE" "ATTEMPT_REPAIR" "NORMALIZE_LOUDNESS" "WRITE_REPLAYGAIN" "TRIM_SILENCE" "M3U_EXTENDED" "LOSSLESS_PASSTHROUGH" "KEEP_COVER_ART")
+for var in "${BOOLEAN_VARS[@]}"; do
+  if [ "${!var}" != "true" ] && [ "${!var}" != "false" ]; then
+    config_errors+=("$var must be true or false, got '${!var}'")
+  fi
+done
+
+if ! [[ "$ICECAST_PORT" =~ ^[0-9]+$ ]] || [ "$ICECAST_PORT" -lt 1 ] || [ "$ICECAST_PORT" -gt 65535 ]; then
+  config_errors+=("ICECAST_PORT must be a number between 1 and 65535, got '$ICECAST_PORT'")
+fi
+if ! [[ "$BITRATE" =~ ^[0-9]+k?$ ]]; then
+  config_errors+=("BITRATE must look like 256k, got '$BITRATE'")
+fi
+if [[ "$MIN_BITRATE_KBPS" =~ ^[0-9]+$ && "$MAX_BITRATE_KBPS" =~ ^[0-9]+$ ]] && [ "$MIN_BITRATE_KBPS" -gt "$MAX_BITRATE_KBPS" ]; then
+  config_errors+=("MIN_BITRATE_KBPS ($MIN_BITRATE_KBPS) is greater than MAX_BITRATE_KBPS ($MAX_BITRATE_KBPS)")
+fi
+if ! [[ "$LOUDNESS_TARGET_LUFS" =~ ^-[0-9]+(\.[0-9]+)?$ ]] || awk -v t="$LOUDNESS_TARGET_LUFS" 'BEGIN { exit !(t < -70 || t > -5) }'; then
+  config_errors+=("LOUDNESS_TARGET_LUFS must be between -70 and -5, got '$LOUDNESS_TARGET_LUFS'")
+fi
+if ! [[ "$SILENCE_THRESHOLD_DB" =~ ^-[0-9]+(\.[0-9]+)?$ ]]; then
+  config_errors+=("SILENCE_THRESHOLD_DB must be a negative number of dB, got '$SILENCE_THRESHOLD_DB'")
+fi
+if ! [[ "$SILENCE_MIN_DURATION_SEC" =~ ^[0-9]+(\.[0-9]+)?$ ]]; then
+  config_errors+=("SILENCE_MIN_DURATION_SEC must be a number of seconds, got '$SILENCE_MIN_DURATION_SEC'")
+fi
+if ! [[ "$OUTPUT_EXTENSION" =~ ^\.[A-Za-z0-9]+$ ]]; then
+  config_errors+=("OUTPUT_EXTENSION must look like .ogg, got '$OUTPUT_EXTENSION'")
+fi
+case "$LOG_LEVEL" in
+  debug|info|warn|error) ;;
+  *) config_errors+=("LOG_LEVEL must be debug, info, warn or error, got '$LOG_LEVEL'") ;;
+esac
+case "$LOG_FORMAT" in
+  text|json) ;;
+  *) config_errors+=("LOG_FORMAT must be text or json, got '$LOG_FORMAT'") ;;
+esac
+case "$DUPLICATE_UPLOADS" in
+  reject|allow) ;;
+  *) config_errors+=("DUPLICATE_UPLOADS must be reject or allow, got '$DUPLICATE_UPLOADS'") ;;
+esac
+for var in SOURCE_PASSWORD_FILE RELAY_PASSWORD_FILE ADMIN_PASSWORD_FILE; do
+  if [ -n "${!var}" ] && [ ! -r "${!var}" ]; then
+    config_errors+=("$var points to ${!var}, which does not exist or is not readable. Run store_secrets.sh first")
+  fi
+done
+
+check_config_errors
+
+# Address that local clients (ices2, the M3U) use to reach Icecast
+if [ "$ICECAST_BIND_ADDRESS" = "0.0.0.0" ]; then
+  ICECAST_LOCAL_ADDRESS="localhost"
+  ICECAST_PUBLIC_ADDRESS="$(hostname -I | awk '{print $1}')"
+else
+  ICECAST_LOCAL_ADDRESS="$ICECAST_BIND_ADDRESS"
+  ICECAST_PUBLIC_ADDRESS="$ICECAST_BIND_ADDRESS"
+fi
+
 # Install necessary packages
-echo "Installing necessary packages..." | tee -a "$LOG_FILE"
-apt update && apt install -y icecast2 ffmpeg ices2 | tee -a "$LOG_FILE"
+echo "Installing necessary packages..." | tee -a "$SETUP_LOG_FILE"
+apt update && apt install -y icecast2 ffmpeg ices2 psmisc | tee -a "$SETUP_LOG_FILE"
+
+# Make sure the installed ffmpeg can produce the configured output
+if ! ffmpeg -hide_banner -encoders 2>/dev/null | awk '{print $2}' | grep -qx "$AUDIO_CODEC"; then
+  echo "Error: The installed ffmpeg has no '$AUDIO_CODEC' encoder. Please update AUDIO_CODEC in $CONFIG_FILE and try again." | tee -a "$SETUP_LOG_FILE"
+  exit 1
+fi
+# ices2 streams Ogg Vorbis only; anything else sits in MUSIC_DIR without ever airing
+if [ "$OUTPUT_EXTENSION" != ".ogg" ] || { [ "$AUDIO_CODEC" != "libvorbis" ] && [ "$AUDIO_CODEC" != "vorbis" ]; }; then
+  echo "Warning: ices2 only streams Ogg Vorbis, so $AUDIO_CODEC $OUTPUT_EXTENSION output will not be played unless another source client reads $MUSIC_DIR." | tee -a "$SETUP_LOG_FILE"
+fi
 
 # Enable and start Icecast service
-echo "Enabling and starting Icecast service..." | tee -a "$LOG_FILE"
-systemctl enable icecast2 | tee -a "$LOG_FILE"
-systemctl start icecast2 | tee -a "$LOG_FILE"
+echo "Enabling and starting Icecast service..." | tee -a "$SETUP_LOG_FILE"
+systemctl enable icecast2 | tee -a "$SETUP_LOG_FILE"
+systemctl start icecast2 | tee -a "$SETUP_LOG_FILE"
 
 # Configure Icecast
-echo "Configuring Icecast..." | tee -a "$LOG_FILE"
+echo "Configuring Icecast..." | tee -a "$SETUP_LOG_FILE"
 source_password=$(cat "$SOURCE_PASSWORD_FILE")
 relay_password=$(cat "$RELAY_PASSWORD_FILE")
 admin_password=$(cat "$ADMIN_PASSWORD_FILE")
@@ -63,13 +298,22 @@ sed -i "s|<source-password>.*</source-password>|<source-password>$source_passwor
 sed -i "s|<relay-password>.*</relay-password>|<relay-password>$relay_password</relay-password>|g" "$ICECAST_CONF"
 sed -i "s|<admin-password>.*</admin-password>|<admin-password>$admin_password</admin-password>|g" "$ICECAST_CONF"
 sed -i "s|<hostname>.*</hostname>|<hostname>$ICECAST_HOSTNAME</hostname>|g" "$ICECAST_CONF"
+sed -i "0,/<port>.*<\/port>/s|<port>.*</port>|<port>$ICECAST_PORT</port>|" "$ICECAST_CONF"
+sed -i -E "0,/<bind-address>/s|(<!-- *)?<bind-address>.*</bind-address>( *-->)?|<bind-address>$ICECAST_BIND_ADDRESS</bind-address>|" "$ICECAST_CONF"
 
-systemctl restart icecast2 | tee -a "$LOG_FILE"
+systemctl restart icecast2 | tee -a "$SETUP_LOG_FILE"
+
+# Create the 'submit' user for uploads
+echo "Creating submit user..." | tee -a "$SETUP_LOG_FILE"
+if ! id -u "$SUBMIT_USER" &>/dev/null; then
+  useradd -m -s /bin/bash "$SUBMIT_USER"
+fi
 
 # Configure ices2
 ICES_CONF="/etc/ices2/ices2.xml"
+ICES_USER="ices2"
 mkdir -p "$(dirname "$ICES_CONF")"
-echo "Creating ices2 configuration..." | tee -a "$LOG_FILE"
+echo "Creating ices2 configuration..." | tee -a "$SETUP_LOG_FILE"
 cat << EOF > "$ICES_CONF"
 <ices>
   <background>1</background>
@@ -92,8 +336,8 @@ cat << EOF > "$ICES_CONF"
     </input>
 
     <instance>
-      <hostname>localhost</hostname>
-      <port>8000</port>
+      <hostname>$ICECAST_LOCAL_ADDRESS</hostname>
+      <port>$ICECAST_PORT</port>
       <password>$source_password</password>
       <mount>/stream</mount>
       <stream_once>0</stream_once>
@@ -103,46 +347,71 @@ cat << EOF > "$ICES_CONF"
 EOF
 
 # Create systemd service for ices2
-echo "Creating systemd service for ices2..." | tee -a "$LOG_FILE"
+echo "Creating systemd service for ices2..." | tee -a "$SETUP_LOG_FILE"
+# ices2 runs under its own account, out of reach of the shared submit user
+if ! id -u "$ICES_USER" &>/dev/null; then
+  useradd --system --no-create-home --shell /usr/sbin/nologin "$ICES_USER"
+fi
+mkdir -p /var/log/ices
+chown -R "$ICES_USER:$ICES_USER" /var/log/ices
 cat << EOF > /etc/systemd/system/ices2.service
 [Unit]
 Description=ICES2 Source Client for Icecast
 After=network.target icecast2.service
 
 [Service]
+User=$ICES_USER
+Group=$ICES_USER
 ExecStart=/usr/bin/ices2 -c $ICES_CONF
-Restart=on-failure
+Restart=always
 
 [Install]
 WantedBy=multi-user.target
 EOF
 
-# Reload systemd and start ices2 service
+# Reload systemd and (re)start ices2 so a changed unit takes effect
 systemctl daemon-reload
 systemctl enable ices2
-systemctl start ices2
+systemctl restart ices2
 
 # Create directories
-echo "Creating directories..." | tee -a "$LOG_FILE"
+echo "Creating directories..." | tee -a "$SETUP_LOG_FILE"
 mkdir -p "$MUSIC_DIR"
 mkdir -p "$UPLOAD_DIR"
-
-# Create the 'submit' user for uploads
-echo "Creating submit user..." | tee -a "$LOG_FILE"
-if ! id -u "$SUBMIT_USER" &>/dev/null; then
-  useradd -m -s /bin/bash "$SUBMIT_USER"
-fi
+mkdir -p "$QUARANTINE_DIR"
+mkdir -p "$STATE_DIR"
+mkdir -p "$FAILED_DIR"
 
 chown -R "$SUBMIT_USER:$SUBMIT_USER" "$UPLOAD_DIR"
 chmod -R 755 "$UPLOAD_DIR"
+chown -R "$SUBMIT_USER:$SUBMIT_USER" "$QUARANTINE_DIR"
+chmod -R 755 "$QUARANTINE_DIR"
+chown -R "$SUBMIT_USER:$SUBMIT_USER" "$FAILED_DIR"
+chmod -R 755 "$FAILED_DIR"
+chown -R "$SUBMIT_USER:$SUBMIT_USER" "$STATE_DIR"
+chmod -R 700 "$STATE_DIR"
+
+# The converter appends to and rotates LOG_FILE as the submit user. Rotation renames
+# files when that user can write the log's directory, and otherwise copies into
+# numbered copies that must already exist and belong to it.
+touch "$LOG_FILE"
+chown "$SUBMIT_USER:$SUBMIT_USER" "$LOG_FILE"
+if [ "$LOG_DIR_CREATED" = "true" ]; then
+  chown "$SUBMIT_USER:$SUBMIT_USER" "$LOG_DIR"
+elif ! sudo -u "$SUBMIT_USER" test -w "$LOG_DIR"; then
+  for ((i = 1; i <= LOG_RETAIN; i++)); do
+    touch "$LOG_FILE.$i"
+    chown "$SUBMIT_USER:$SUBMIT_USER" "$LOG_FILE.$i"
+  done
+fi
 
 # Ensure /var/music has the correct permissions
 if [ ! -w "$MUSIC_DIR" ]; then
-  echo "Error: Cannot write to target directory $MUSIC_DIR. Attempting to fix permissions..." | tee -a "$LOG_FILE"
+  echo "Error: Cannot write to target directory $MUSIC_DIR. Attempting to fix permissions..." | tee -a "$SETUP_LOG_FILE"
   sudo chown -R "$SUBMIT_USER:$SUBMIT_USER" "$MUSIC_DIR"
   sudo chmod -R 755 "$MUSIC_DIR"
   if [ ! -w "$MUSIC_DIR" ]; then
-    echo "Error: Still cannot write to $MUSIC_DIR after attempting to fix permissions." | tee -a "$LOG_FILE"
+    echo "Error: Still cannot write to $MUSIC_DIR after attempting to fix permissions." | tee -a "$SETUP_LOG_FILE"
     exit 1
   fi
 fi
@@ -154,89 +423,825 @@ chmod 700 "/home/$SUBMIT_USER/.ssh"
 chmod 600 "/home/$SUBMIT_USER/.ssh/authorized_keys"
 
 # Create the converter script
-echo "Creating file converter script..." | tee -a "$LOG_FILE"
-cat << EOF > "$CONVERTER_SCRIPT"
-#!/bin/bash
-
-UPLOAD_DIR="$UPLOAD_DIR"
-MUSIC_DIR="$MUSIC_DIR"
-SUPPORTED_FORMATS="$SUPPORTED_FORMATS"
-BITRATE="$BITRATE"
-SAMPLE_RATE="$SAMPLE_RATE"
-AUDIO_CODEC="$AUDIO_CODEC"
-LOG_FILE="$LOG_FILE"
+echo "Creating file converter script..." | tee -a "$SETUP_LOG_FILE"
+# Write the settings with printf %q, so no value can break out of its assignment
+CONVERTER_SETTINGS=(
+  "UPLOAD_DIR" "MUSIC_DIR" "SUPPORTED_FORMATS" "BITRATE" "TARGET_SIZE_KB" "MIN_BITRATE_KBPS"
+  "MAX_BITRATE_KBPS" "SAMPLE_RATE" "AUDIO_CODEC" "OUTPUT_EXTENSION" "LOSSLESS_PASSTHROUGH"
+  "AUDIO_STREAM_INDEX" "AUDIO_CHANNELS" "PARTIAL_FILE_PATTERNS" "TAG_PROVENANCE" "KEEP_COVER_ART"
+  "DUPLICATE_UPLOADS" "ATTEMPT_REPAIR" "CONVERTER_WORKERS" "UPLOAD_POLL_INTERVAL_SEC" "UPLOAD_STABLE_POLLS"
+  "LOG_FILE" "LOG_LEVEL" "LOG_FORMAT" "QUARANTINE_DIR" "STATE_DIR" "FAILED_DIR" "MAX_CONVERSION_ATTEMPTS"
+  "RETRY_BASE_DELAY_SEC" "NORMALIZE_LOUDNESS" "LOUDNESS_TARGET_LUFS" "WRITE_REPLAYGAIN" "TRIM_SILENCE"
+  "SILENCE_THRESHOLD_DB" "SILENCE_MIN_DURATION_SEC" "MAX_LIBRARY_MB" "MAX_LIBRARY_FILES"
+  "MAX_LIBRARY_AGE_DAYS" "MIN_FREE_DISK_MB" "LOG_MAX_SIZE_KB" "LOG_RETAIN"
+)
+{
+  echo "#!/bin/bash"
+  echo
+  for var in "${CONVERTER_SETTINGS[@]}"; do
+    printf '%s=%q\n' "$var" "${!var}"
+  done
+} > "$CONVERTER_SCRIPT"
+cat << EOF >> "$CONVERTER_SCRIPT"
 LOCK_FILE="/tmp/riverrun_converter.lock"
+# SHA-256 of each converted upload and the library file it became
+HASH_INDEX="\$STATE_DIR/upload_hashes"
+
+LOG_LEVELS=(debug info warn error)
+
+# Print the numeric rank of a log level, or nothing if it isn't known
+log_rank() {
+  local i
+  for i in "\${!LOG_LEVELS[@]}"; do
+    if [ "\${LOG_LEVELS[\$i]}" = "\$1" ]; then
+      echo "\$i"
+      return
+    fi
+  done
+}
+
+# Escape a string for use inside a JSON string literal
+json_escape() {
+  local s="\$1"
+  s="\${s//\\\\/\\\\\\\\}"
+  s="\${s//\"/\\\\\"}"
+  s="\${s//\$'\\n'/\\\\n}"
+  s="\${s//\$'\\r'/\\\\r}"
+  s="\${s//\$'\\t'/\\\\t}"
+  echo "\$s"
+}
+
+# Append a message to LOG_FILE if its level is at or above LOG_LEVEL
+log_msg() {
+  local level="\$1"
+  local message="\$2"
+  local timestamp
+  if [ "\$(log_rank "\$level")" -lt "\$(log_rank "\$LOG_LEVEL")" ]; then
+    return
+  fi
+  timestamp="\$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+  if [ "\$LOG_FORMAT" = "json" ]; then
+    echo "{\\"time\\":\\"\$timestamp\\",\\"level\\":\\"\$level\\",\\"msg\\":\\"\$(json_escape "\$message")\\"}" >> "\$LOG_FILE"
+  else
+    echo "\$timestamp [\${level^^}] \$message" >> "\$LOG_FILE"
+  fi
+}
+
+# Run a command, logging its output at debug level, or at error level if it fails.
+# The output is also left in last_output for the caller.
+run_logged() {
+  local output status
+  output="\$("\$@" 2>&1)"
+  status=\$?
+  last_output="\$output"
+  if [ \$status -eq 0 ]; then
+    log_msg debug "\$1 output: \$output"
+  else
+    log_msg error "\$1 exited with status \$status: \$output"
+  fi
+  return \$status
+}
+
+if [ -z "\$(log_rank "\$LOG_LEVEL")" ]; then
+  LOG_LEVEL="info"
+fi
+
+# Move each numbered copy of the log up one and start a fresh log. Renaming needs
+# write access to the log's directory. Without it, each file's contents are copied
+# into the next and the log is truncated, which needs only the files to be writable.
+shift_logs() {
+  local i
+  if [ "\$LOG_RETAIN" -lt 1 ]; then
+    : > "\$LOG_FILE"
+  elif [ -w "\$(dirname "\$LOG_FILE")" ]; then
+    rm -f "\$LOG_FILE.\$LOG_RETAIN" || return 1
+    for ((i = LOG_RETAIN - 1; i >= 1; i--)); do
+      if [ -f "\$LOG_FILE.\$i" ]; then
+        mv -f "\$LOG_FILE.\$i" "\$LOG_FILE.\$((i + 1))" || return 1
+      fi
+    done
+    mv -f "\$LOG_FILE" "\$LOG_FILE.1"
+  else
+    for ((i = LOG_RETAIN - 1; i >= 1; i--)); do
+      if [ -f "\$LOG_FILE.\$i" ]; then
+        cat "\$LOG_FILE.\$i" > "\$LOG_FILE.\$((i + 1))" || return 1
+      fi
+    done
+    cat "\$LOG_FILE" > "\$LOG_FILE.1" && : > "\$LOG_FILE"
+  fi
+}
+
+# Rotate the log once it grows past LOG_MAX_SIZE_KB, keeping LOG_RETAIN old copies
+rotate_log() {
+  local size_kb output
+  [ -f "\$LOG_FILE" ] || return 0
+  size_kb=\$(( \$(stat -c %s "\$LOG_FILE") / 1024 ))
+  if [ "\$LOG_MAX_SIZE_KB" -le 0 ] || [ "\$size_kb" -lt "\$LOG_MAX_SIZE_KB" ]; then
+    return 0
+  fi
+  if ! output="\$(shift_logs 2>&1)"; then
+    log_msg warn "Could not rotate \$LOG_FILE at \$size_kb KB: \$output"
+  fi
+}
+
+# Print the bitrate needed to hit TARGET_SIZE_KB, or BITRATE if that can't be computed
+target_bitrate() {
+  local duration
+  if [ "\$TARGET_SIZE_KB" -le 0 ]; then
+    echo "\$BITRATE"
+    return
+  fi
+  duration="\$(ffprobe -v error -show_entries format=duration -of csv=p=0 "\$1")"
+  if ! awk -v d="\$duration" 'BEGIN { exit !(d + 0 > 0) }'; then
+    log_msg warn "Cannot read duration of \$1 for target size. Using \$BITRATE."
+    echo "\$BITRATE"
+    return
+  fi
+  awk -v size="\$TARGET_SIZE_KB" -v d="\$duration" -v min="\$MIN_BITRATE_KBPS" -v max="\$MAX_BITRATE_KBPS" 'BEGIN {
+    kbps = int(size * 8 * 1.024 / d)
+    if (kbps < min) kbps = min
+    if (kbps > max) kbps = max
+    printf "%dk\\n", kbps
+  }'
+}
+
+# Succeed if an ffmpeg encoder produces lossless audio
+is_lossless_codec() {
+  case "\$1" in
+    flac|alac|wavpack|tta|pcm_*) return 0 ;;
+  esac
+  return 1
+}
+
+# Print the standard channel layout name for a channel count. These are the layouts
+# the Vorbis channel mapping defines, with surround channels at the back for 5 and 6.
+channel_layout() {
+  case "\$1" in
+    1) echo "mono" ;;
+    2) echo "stereo" ;;
+    3) echo "3.0" ;;
+    4) echo "quad" ;;
+    5) echo "5.0(back)" ;;
+    6) echo "5.1(back)" ;;
+    7) echo "6.1" ;;
+    8) echo "7.1" ;;
+  esac
+}
+
+# Succeed if MUSIC_DIR's filesystem has at least MIN_FREE_DISK_MB available
+has_free_space() {
+  local free_mb
+  free_mb=\$(df -Pm "\$MUSIC_DIR" | awk 'NR == 2 { print \$4 }')
+  log_msg debug "\$MUSIC_DIR has \$free_mb MB free"
+  [ "\$free_mb" -ge "\$MIN_FREE_DISK_MB" ]
+}
+
+# Succeed if a process has the file open. fuser silently skips processes it may not
+# inspect, so a missing fuser or an ices2 process hidden from this user also counts as in use.
+file_in_use() {
+  local pid
+  if ! command -v fuser >/dev/null 2>&1; then
+    return 0
+  fi
+  if fuser -s "\$1" 2>/dev/null; then
+    return 0
+  fi
+  for pid in \$(pgrep -x ices2); do
+    if [ ! -r "/proc/\$pid/fd" ]; then
+      return 0
+    fi
+  done
+  return 1
+}
+
+# Delete the oldest files in MUSIC_DIR, by mtime, while any pruning policy is
+# exceeded: MAX_LIBRARY_MB total size, MAX_LIBRARY_FILES count or MAX_LIBRARY_AGE_DAYS age.
+# Files that may be in use, such as the track ices2 is playing, are never removed, and
+# hidden files are conversions still in progress.
+prune_library() {
+  local limit_bytes total count now mtime size file reason
+  if [ "\$MAX_LIBRARY_MB" -le 0 ] && [ "\$MAX_LIBRARY_FILES" -le 0 ] && [ "\$MAX_LIBRARY_AGE_DAYS" -le 0 ]; then
+    return 0
+  fi
+  limit_bytes=\$((MAX_LIBRARY_MB * 1024 * 1024))
+  total=\$(find "\$MUSIC_DIR" -maxdepth 1 -type f ! -name '.*' -printf '%s\\n' | awk '{ t += \$1 } END { print t + 0 }')
+  count=\$(find "\$MUSIC_DIR" -maxdepth 1 -type f ! -name '.*' | wc -l)
+  now=\$(date +%s)
+  while read -r mtime size file; do
+    if [ "\$MAX_LIBRARY_AGE_DAYS" -gt 0 ] && [ \$((now - \${mtime%.*})) -gt \$((MAX_LIBRARY_AGE_DAYS * 86400)) ]; then
+      reason="it is older than \$MAX_LIBRARY_AGE_DAYS days"
+    elif [ "\$MAX_LIBRARY_MB" -gt 0 ] && [ "\$total" -gt "\$limit_bytes" ]; then
+      reason="library is over \$MAX_LIBRARY_MB MB"
+    elif [ "\$MAX_LIBRARY_FILES" -gt 0 ] && [ "\$count" -gt "\$MAX_LIBRARY_FILES" ]; then
+      reason="library is over \$MAX_LIBRARY_FILES files"
+    else
+      break
+    fi
+    if file_in_use "\$file"; then
+      log_msg warn "Would prune \$file because \$reason, but it is or may be in use. Skipping."
+      continue
+    fi
+    if rm -f "\$file"; then
+      total=\$((total - size))
+      count=\$((count - 1))
+      log_msg info "Pruned \$file (\$size bytes) because \$reason"
+    fi
+  done < <(find "\$MUSIC_DIR" -maxdepth 1 -type f ! -name '.*' -printf '%T@ %s %p\\n' | sort -n)
+}
+
+# Print the Vorbis comment name for an ID3v2 frame that ffmpeg leaves unmapped
+vorbis_tag_name() {
+  case "\$1" in
+    TDOR|TORY) echo "ORIGINALDATE" ;;
+    TSRC) echo "ISRC" ;;
+    TBPM) echo "BPM" ;;
+    TMED) echo "MEDIA" ;;
+    TIT3) echo "SUBTITLE" ;;
+    TEXT) echo "LYRICIST" ;;
+    TPE4) echo "REMIXER" ;;
+  esac
+}
+
+# Print the path of a per-upload state file, keyed so a replaced upload starts fresh
+state_file() {
+  local file="\$1"
+  local suffix="\$2"
+  echo "\$STATE_DIR/\$(basename "\$file")-\$(stat -c %Y-%s "\$file").\$suffix"
+}
+
+# Print a second-pass loudnorm filter for the file, measuring it first unless a
+# measurement from an earlier run is cached in STATE_DIR
+loudnorm_filter() {
+  local file="\$1"
+  local stream_index="\$2"
+  local target="I=\$LOUDNESS_TARGET_LUFS:TP=-1.5:LRA=11"
+  local cache analysis measured key value
+  local input_i input_tp input_lra input_thresh target_offset
+  cache="\$(state_file "\$file" loudnorm)"
+  if [ ! -s "\$cache" ]; then
+    if ! analysis="\$(ffmpeg -hide_banner -nostats -i "\$file" -map "0:a:\$stream_index" -af "loudnorm=\$target:print_format=json" -f null - 2>&1)"; then
+      log_msg warn "Loudness analysis failed for \$file. Converting without normalization."
+      return 1
+    fi
+    measured=""
+    for key in input_i input_tp input_lra input_thresh target_offset; do
+      value="\$(echo "\$analysis" | sed -n "s/.*\\"\$key\\" *: *\\"\\([^\\"]*\\)\\".*/\\1/p" | tail -n 1)"
+      if [ -z "\$value" ]; then
+        log_msg warn "Loudness analysis of \$file did not report \$key. Converting without normalization."
+        return 1
+      fi
+      measured="\$measured \$value"
+    done
+    echo "\$measured" > "\$cache"
+  fi
+  read -r input_i input_tp input_lra input_thresh target_offset < "\$cache"
+  log_msg info "Measured \$file at \$input_i LUFS, normalizing to \$LOUDNESS_TARGET_LUFS LUFS"
+  echo "loudnorm=\$target:measured_I=\$input_i:measured_TP=\$input_tp:measured_LRA=\$input_lra:measured_thresh=\$input_thresh:offset=\$target_offset:linear=true"
+}
+
+# Print the duration of a media file in seconds, or nothing if ffprobe can't read one
+media_duration() {
+  ffprobe -v error -show_entries format=duration -of csv=p=0 "\$1" 2>/dev/null | awk '\$1 + 0 > 0 { print \$1 + 0 }'
+}
+
+# Print the start and end, in seconds, of the audio to keep once leading and trailing
+# silence are trimmed, followed by the total seconds trimmed. Fails if there is nothing to trim.
+silence_bounds() {
+  local file="\$1"
+  local stream_index="\$2"
+  local duration analysis bounds start end trailing
+  duration="\$(media_duration "\$file")"
+  if [ -z "\$duration" ]; then
+    log_msg warn "Cannot read duration of \$file. Converting without trimming silence."
+    return 1
+  fi
+  if ! analysis="\$(ffmpeg -hide_banner -nostats -i "\$file" -map "0:a:\$stream_index" -af "silencedetect=noise=\${SILENCE_THRESHOLD_DB}dB:duration=\$SILENCE_MIN_DURATION_SEC" -f null - 2>&1)"; then
+    log_msg warn "Silence detection failed for \$file. Converting without trimming silence."
+    return 1
+  fi
+  # Only a silence starting at 0 is leading, and only one running to the end is trailing
+  bounds="\$(echo "\$analysis" | awk -v d="\$duration" '
+    /silence_start:/ {
+      for (i = 1; i < NF; i++) if (\$i == "silence_start:") s = \$(i + 1) + 0
+      silent = 1
+      n++
+    }
+    /silence_end:/ {
+      for (i = 1; i < NF; i++) if (\$i == "silence_end:") e = \$(i + 1) + 0
+      silent = 0
+      if (n == 1 && s <= 0.05) start = e
+    }
+    END {
+      end = d
+      if (silent) end = s
+      else if (n > 0 && e >= d - 0.05) end = s
+      if (end <= start || (start == 0 && end == d)) exit 1
+      printf "%.3f %.3f\\n", start, end
+    }')" || return 1
+  read -r start end <<< "\$bounds"
+  trailing="\$(awk -v d="\$duration" -v e="\$end" 'BEGIN { printf "%.3f", d - e }')"
+  log_msg info "Trimming \${start}s of leading and \${trailing}s of trailing silence from \$file"
+  echo "\$start \$end \$(awk -v s="\$start" -v t="\$trailing" 'BEGIN { printf "%.3f", s + t }')"
+}
+
+# Check that a converted file is complete before its source is removed, allowing
+# for the seconds of silence trimmed from it. Prints the reason on failure.
+verify_output() {
+  local source="\$1"
+  local target="\$2"
+  local trimmed="\${3:-0}"
+  local source_duration target_duration
+  if [ ! -s "\$target" ]; then
+    echo "output \$target is missing or empty"
+    return 1
+  fi
+  target_duration="\$(media_duration "\$target")"
+  if [ -z "\$target_duration" ]; then
+    echo "output \$target has no readable duration"
+    return 1
+  fi
+  source_duration="\$(media_duration "\$source")"
+  if [ -n "\$source_duration" ] && awk -v s="\$source_duration" -v t="\$target_duration" -v x="\$trimmed" 'BEGIN { exit !(t < (s - x) * 0.9) }'; then
+    echo "output is \${target_duration}s but source is \${source_duration}s with \${trimmed}s of silence trimmed"
+    return 1
+  fi
+  log_msg debug "Verified \$target: \${target_duration}s from \${source_duration:-unknown}s source"
+}
+
+# Measure a converted file with ebur128 and write ReplayGain 2.0 track tags into it
+add_replaygain() {
+  local target="\$1"
+  local analysis loudness peak_db gain peak tagged
+  if ! analysis="\$(ffmpeg -hide_banner -nostats -i "\$target" -map 0:a:0 -af ebur128=peak=true -f null - 2>&1)"; then
+    log_msg warn "ReplayGain analysis failed for \$target. Leaving it untagged."
+    return 1
+  fi
+  loudness="\$(echo "\$analysis" | awk '\$1 == "I:" { v = \$2 } END { print v }')"
+  peak_db="\$(echo "\$analysis" | awk '\$1 == "Peak:" { v = \$2 } END { print v }')"
+  if [ -z "\$loudness" ] || [ -z "\$peak_db" ]; then
+    log_msg warn "ReplayGain analysis of \$target reported no loudness or peak. Leaving it untagged."
+    return 1
+  fi
+  # ReplayGain 2.0 uses a -18 LUFS reference level
+  gain="\$(awk -v i="\$loudness" 'BEGIN { printf "%+.2f dB", -18 - i }')"
+  peak="\$(awk -v p="\$peak_db" 'BEGIN { printf "%.6f", 10 ^ (p / 20) }')"
+  tagged="\$(dirname "\$target")/.\$(basename "\$target")"
+  if run_logged ffmpeg -y -i "\$target" -map 0 -c copy -map_metadata 0 \\
+    -metadata "REPLAYGAIN_TRACK_GAIN=\$gain" -metadata "REPLAYGAIN_TRACK_PEAK=\$peak" \\
+    -metadata:s:a:0 "REPLAYGAIN_TRACK_GAIN=\$gain" -metadata:s:a:0 "REPLAYGAIN_TRACK_PEAK=\$peak" "\$tagged" &&
+    mv -f "\$tagged" "\$target"; then
+    log_msg info "Tagged \$target with ReplayGain \$gain, peak \$peak"
+  else
+    rm -f "\$tagged"
+    log_msg warn "Could not write ReplayGain tags to \$target. Leaving it untagged."
+    return 1
+  fi
+}
+
+# Print a path in a directory for a file name, adding a -N suffix before the
+# extension if the name is already taken
+unique_path() {
+  local dir="\$1"
+  local name="\$2"
+  local path="\$dir/\$name"
+  local n=1
+  while [ -e "\$path" ]; do
+    if [[ "\$name" == ?*.* ]]; then
+      path="\$dir/\${name%.*}-\$n.\${name##*.}"
+    else
+      path="\$dir/\$name-\$n"
+    fi
+    n=\$((n + 1))
+  done
+  echo "\$path"
+}
+
+# Print the library file converted from an upload with this SHA-256, if it is still in MUSIC_DIR
+find_duplicate() {
+  local target
+  [ -f "\$HASH_INDEX" ] || return 1
+  while IFS= read -r target; do
+    if [ -f "\$target" ]; then
+      echo "\$target"
+      return 0
+    fi
+  done < <(awk -v h="\$1" '\$1 == h { sub(/^[^ ]+ /, ""); print }' "\$HASH_INDEX")
+  return 1
+}
+
+# Drop index entries whose library file has since been pruned or removed
+compact_hash_index() {
+  local compacted hash target
+  [ -f "\$HASH_INDEX" ] || return 0
+  compacted="\$(mktemp "\$HASH_INDEX.XXXXXX")"
+  while read -r hash target; do
+    if [ -f "\$target" ]; then
+      echo "\$hash \$target"
+    fi
+  done < "\$HASH_INDEX" > "\$compacted"
+  mv -f "\$compacted" "\$HASH_INDEX"
+}
+
+# Remove attempts and loudnorm state left by uploads that are gone or have changed since
+prune_state() {
+  local file suffix state
+  local -A live
+  for file in "\$UPLOAD_DIR"/*; do
+    if [ -f "\$file" ]; then
+      for suffix in attempts loudnorm; do
+        live["\$(state_file "\$file" "\$suffix")"]=1
+      done
+    fi
+  done
+  for state in "\$STATE_DIR"/*.attempts "\$STATE_DIR"/*.loudnorm; do
+    if [ -f "\$state" ] && [ -z "\${live[\$state]}" ]; then
+      log_msg debug "Removing stale state file \$state"
+      rm -f "\$state"
+    fi
+  done
+}
+
+# Succeed if an earlier failed conversion of the file is still backing off
+retry_pending() {
+  local attempts_file attempts next_attempt
+  attempts_file="\$(state_file "\$1" attempts)"
+  [ -f "\$attempts_file" ] || return 1
+  read -r attempts next_attempt < "\$attempts_file"
+  [ "\$(date +%s)" -lt "\$next_attempt" ]
+}
+
+# Record a failed conversion. Schedule a retry with exponential backoff, or move
+# the file to FAILED_DIR with the ffmpeg output once MAX_CONVERSION_ATTEMPTS is reached.
+record_failure() {
+  local file="\$1"
+  local output="\$2"
+  local attempts_file loudnorm_file attempts next_attempt delay failed_path
+  attempts_file="\$(state_file "\$file" attempts)"
+  loudnorm_file="\$(state_file "\$file" loudnorm)"
+  attempts=0
+  if [ -f "\$attempts_file" ]; then
+    read -r attempts next_attempt < "\$attempts_file"
+  fi
+  attempts=\$((attempts + 1))
+  if [ "\$attempts" -ge "\$MAX_CONVERSION_ATTEMPTS" ]; then
+    failed_path="\$(unique_path "\$FAILED_DIR" "\$(basename "\$file")")"
+    if mv "\$file" "\$failed_path"; then
+      rm -f "\$attempts_file" "\$loudnorm_file"
+      echo "\$output" > "\$failed_path.err"
+      log_msg error "Giving up on \$file after \$attempts attempts. Moved to \$failed_path"
+      return
+    fi
+    # Keep the upload, the only copy, and keep backing off until it can be moved
+    log_msg error "Giving up on \$file after \$attempts attempts, but could not move it to \$FAILED_DIR. Leaving it in place."
+  fi
+  delay=\$((RETRY_BASE_DELAY_SEC * (1 << (attempts - 1))))
+  echo "\$attempts \$(( \$(date +%s) + delay ))" > "\$attempts_file"
+  if [ "\$attempts" -lt "\$MAX_CONVERSION_ATTEMPTS" ]; then
+    log_msg warn "Conversion attempt \$attempts of \$MAX_CONVERSION_ATTEMPTS failed for \$file. Retrying in \$delay seconds."
+  fi
+}
+
+# Check that an upload has finished arriving. Returns 0 when no process has it open
+# and its size has held steady for UPLOAD_STABLE_POLLS polls, 1 while it is still
+# being written, and 2 if it disappeared.
+upload_ready() {
+  local file="\$1"
+  local window size last_size polls
+  if fuser -s "\$file" 2>/dev/null; then
+    return 1
+  fi
+  window=\$((UPLOAD_POLL_INTERVAL_SEC * UPLOAD_STABLE_POLLS))
+  # Files untouched for the whole window don't need polling
+  if [ \$((\$(date +%s) - \$(stat -c %Y "\$file" 2>/dev/null || echo 0))) -ge "\$window" ]; then
+    [ -f "\$file" ] || return 2
+    return 0
+  fi
+  last_size=\$(stat -c %s "\$file" 2>/dev/null) || return 2
+  polls=0
+  while [ "\$polls" -lt "\$UPLOAD_STABLE_POLLS" ]; do
+    sleep "\$UPLOAD_POLL_INTERVAL_SEC"
+    size=\$(stat -c %s "\$file" 2>/dev/null) || return 2
+    if [ "\$size" != "\$last_size" ]; then
+      return 1
+    fi
+    polls=\$((polls + 1))
+  done
+  if fuser -s "\$file" 2>/dev/null; then
+    return 1
+  fi
+  return 0
+}
+
+# Succeed if the file name looks like an in-progress rsync/scp/sftp transfer
+is_partial_upload() {
+  local name="\$(basename "\$1")"
+  local patterns pattern
+  read -ra patterns <<< "\$PARTIAL_FILE_PATTERNS"
+  for pattern in "\${patterns[@]}"; do
+    if [[ "\$name" == \$pattern ]]; then
+      return 0
+    fi
+  done
+  return 1
+}
+
+# Move a file that can never be converted out of the upload directory
+quarantine() {
+  local file="\$1"
+  local reason="\$2"
+  local quarantine_path="\$(unique_path "\$QUARANTINE_DIR" "\$(basename "\$file")")"
+  if mv "\$file" "\$quarantine_path"; then
+    echo "\$reason" > "\$quarantine_path.reason"
+    log_msg warn "Quarantined \$file to \$quarantine_path: \$reason"
+  else
+    log_msg error "Failed to quarantine \$file (\$reason). Leaving it in place."
+  fi
+}
+
+# Print a reason if the file's audio is encrypted or has no decoder. Files ffprobe
+# can't read at all are left to the normal conversion, repair and retry path.
+check_decodable() {
+  local streams
+  if ! streams="\$(ffprobe -v error -select_streams a -show_entries stream=codec_name,codec_tag_string -of csv=p=0 "\$1" 2>/dev/null)"; then
+    return 0
+  fi
+  case "\$streams" in
+    *drms*|*enca*)
+      echo "encrypted (DRM-protected) audio stream"
+      return 1
+      ;;
+    none,*|unknown,*)
+      echo "no decoder for audio stream (\$streams)"
+      return 1
+      ;;
+  esac
+  return 0
+}
+
+# Root's cron runs the converter with --prune, since only root's fuser can see which
+# file ices2, under its own account, has open
+if [ "\$1" = "--prune" ]; then
+  # Don't leave a root-owned log behind if this run is the one that creates it
+  if [ ! -e "\$LOG_FILE" ]; then
+    touch "\$LOG_FILE" && chown --reference="\$(dirname "\$LOG_FILE")" "\$LOG_FILE"
+  fi
+  prune_library
+  exit 0
+fi
 
 if [ -f "\$LOCK_FILE" ]; then
-  echo "Script already running. Exiting." >> "\$LOG_FILE"
+  log_msg warn "Script already running. Exiting."
   exit 1
 fi
 
 trap 'rm -f "\$LOCK_FILE"' EXIT
 touch "\$LOCK_FILE"
 
-echo "Starting file detection in \$UPLOAD_DIR at \$(date)" >> "\$LOG_FILE"
+rotate_log
+
+log_msg info "Starting file detection in \$UPLOAD_DIR"
 if [ ! -w "\$MUSIC_DIR" ]; then
-  echo "Error: Cannot write to target directory \$MUSIC_DIR. Check permissions." >> "\$LOG_FILE"
+  log_msg error "Cannot write to target directory \$MUSIC_DIR. Check permissions."
   exit 1
 fi
 
-files_found=0
-for file in "\$UPLOAD_DIR"/*; do
-  echo "Checking file: \$file" >> "\$LOG_FILE"
-  if [ -f "\$file" ]; then
-    files_found=1
-    echo "Processing file: \$file" >> "\$LOG_FILE"
-    if [ ! -r "\$file" ]; then
-      echo "Error: Cannot read file \$file. Check permissions." >> "\$LOG_FILE"
-      continue
+# Convert one upload into MUSIC_DIR, or quarantine or delete it
+process_file() {
+  local file="\$1"
+  local extension reason uuid target_file work_file stream_index audio_streams bitrate
+  local filters channels layout converted repaired_file loudnorm last_output ready
+  local bounds trim_start trim_end trimmed
+  local ffmpeg_args metadata_args copy_args art_args art_stream key value vorbis_key hash duplicate
+  log_msg debug "Processing file: \$file"
+  if [ ! -r "\$file" ]; then
+    log_msg error "Cannot read file \$file. Check permissions."
+    return
+  fi
+  upload_ready "\$file" && ready=0 || ready=\$?
+  if [ "\$ready" -eq 1 ]; then
+    log_msg info "\$file is still being uploaded. Leaving it for a later run."
+    return
+  elif [ "\$ready" -eq 2 ]; then
+    log_msg warn "\$file disappeared before it could be processed"
+    return
+  fi
+
+  extension=".\${file##*.}"
+  log_msg debug "Detected extension: \$extension for \$file"
+  if echo "\$SUPPORTED_FORMATS" | grep -q "\$extension"; then
+    if ! reason="\$(check_decodable "\$file")"; then
+      quarantine "\$file" "\$reason"
+      return
+    fi
+    if retry_pending "\$file"; then
+      log_msg debug "Waiting to retry \$file"
+      return
+    fi
+    # Hashes are always recorded, so switching DUPLICATE_UPLOADS to reject covers earlier uploads too
+    hash="\$(sha256sum "\$file" | cut -d ' ' -f 1)"
+    if [ "\$DUPLICATE_UPLOADS" = "reject" ] && duplicate="\$(find_duplicate "\$hash")"; then
+      log_msg info "\$file is identical to \$duplicate, which is already in the library. Deleting..."
+      rm -f "\$file"
+      return
+    fi
+    uuid="\$(cat /proc/sys/kernel/random/uuid)"
+    target_file="\$MUSIC_DIR/\$uuid\$OUTPUT_EXTENSION"
+    # Encode to a hidden name and rename when done, so ices2 never sees a partial file
+    work_file="\$MUSIC_DIR/.\$uuid\$OUTPUT_EXTENSION"
+    log_msg info "Converting \$file to \$target_file with ffmpeg..."
+    # Encode only the selected audio stream; drop data, subtitles and chapters, and video
+    # other than cover art kept by KEEP_COVER_ART
+    stream_index="\$AUDIO_STREAM_INDEX"
+    audio_streams=\$(ffprobe -v error -select_streams a -show_entries stream=index -of csv=p=0 "\$file" | wc -l)
+    if [ "\$stream_index" -ge "\$audio_streams" ]; then
+      log_msg warn "Audio stream \$stream_index not present in \$file (\$audio_streams found). Using the first audio stream."
+      stream_index=0
+    fi
+    ffmpeg_args=(-map "0:a:\$stream_index" -dn -sn -map_chapters -1)
+    bitrate="\$(target_bitrate "\$file")"
+    ffmpeg_args+=(-acodec "\$AUDIO_CODEC" -b:a "\$bitrate" -ar "\$SAMPLE_RATE")
+
+    filters=()
+    trimmed=0
+    if [ "\$TRIM_SILENCE" = "true" ] && bounds="\$(silence_bounds "\$file" "\$stream_index")"; then
+      # Cut only the two ends found by silence_bounds, leaving gaps mid-track alone
+      read -r trim_start trim_end trimmed <<< "\$bounds"
+      filters+=("atrim=start=\$trim_start:end=\$trim_end" "asetpts=PTS-STARTPTS")
+    fi
+    if [ "\$NORMALIZE_LOUDNESS" = "true" ] && loudnorm="\$(loudnorm_filter "\$file" "\$stream_index")"; then
+      filters+=("\$loudnorm")
+    fi
+    # Set an explicit channel layout so players don't trust a wrong one from the source
+    channels="\$AUDIO_CHANNELS"
+    if [ "\$channels" -le 0 ]; then
+      channels=\$(ffprobe -v error -select_streams "a:\$stream_index" -show_entries stream=channels -of csv=p=0 "\$file")
+    fi
+    layout="\$(channel_layout "\$channels")"
+    if [ -n "\$layout" ]; then
+      ffmpeg_args+=(-ac "\$channels")
+      filters+=("aformat=channel_layouts=\$layout")
+    else
+      log_msg warn "No standard channel layout for '\$channels' channels in \$file. Keeping the source layout."
+    fi
+
+    art_args=(-vn)
+    if [ "\$KEEP_COVER_ART" = "true" ]; then
+      art_stream="\$(ffprobe -v error -select_streams v -show_entries stream=index:stream_disposition=attached_pic -of csv=p=0 "\$file" | awk -F, '\$2 == 1 { print \$1; exit }')"
+      if [ -n "\$art_stream" ]; then
+        art_args=(-map "0:\$art_stream" -c:v copy -disposition:v:0 attached_pic)
+      fi
     fi
 
-    extension=".\${file##*.}"
-    echo "Detected extension: \$extension for \$file" >> "\$LOG_FILE"
-    if echo "\$SUPPORTED_FORMATS" | grep -q "\$extension"; then
-      uuid="\$(cat /proc/sys/kernel/random/uuid)"
-      target_file="\$MUSIC_DIR/\$uuid.ogg"
-      echo "Converting \$file to \$target_file with ffmpeg..." >> "\$LOG_FILE"
-      if ffmpeg -y -i "\$file" -acodec "\$AUDIO_CODEC" -b:a "\$BITRATE" -ar "\$SAMPLE_RATE" "\$target_file" >> "\$LOG_FILE" 2>&1; then
-        rm -f "\$file"
-        echo "Successfully converted \$file to \$target_file" >> "\$LOG_FILE"
+    # Carry tags over from the container and from the selected audio stream
+    metadata_args=(-map_metadata 0 -map_metadata:s:a:0 "0:s:a:\$stream_index")
+    while IFS='=' read -r key value; do
+      vorbis_key="\$(vorbis_tag_name "\$key")"
+      if [ -n "\$vorbis_key" ]; then
+        metadata_args+=(-metadata "\$key=" -metadata "\$vorbis_key=\$value")
+      fi
+    done < <(ffprobe -v error -show_entries format_tags -of default=noprint_wrappers=1 "\$file" | sed 's/^TAG://')
+    if [ "\$TAG_PROVENANCE" = "true" ]; then
+      metadata_args+=(-metadata "RIVERRUN_ORIGINAL_NAME=\$(basename "\$file")")
+      # ctime rather than mtime, which rsync -t and scp -p carry over from the uploader's copy
+      metadata_args+=(-metadata "RIVERRUN_UPLOADED_AT=\$(date -u -d "@\$(stat -c %Z "\$file")" +%Y-%m-%dT%H:%M:%SZ)")
+      metadata_args+=(-metadata "RIVERRUN_CONVERTED_AT=\$(date -u +%Y-%m-%dT%H:%M:%SZ)")
+    fi
+    ffmpeg_args+=("\${metadata_args[@]}")
+    if [ \${#filters[@]} -gt 0 ]; then
+      ffmpeg_args+=(-af "\$(IFS=,; echo "\${filters[*]}")")
+    fi
+
+    # A lossless source already in the lossless output codec can be copied untouched,
+    # as long as it has the output sample rate and channel layout and no filter changes the audio
+    copy_args=()
+    if [ "\$LOSSLESS_PASSTHROUGH" = "true" ] && is_lossless_codec "\$AUDIO_CODEC" &&
+      [ "\$TRIM_SILENCE" != "true" ] && [ "\$NORMALIZE_LOUDNESS" != "true" ] &&
+      [ "\$(ffprobe -v error -select_streams "a:\$stream_index" -show_entries stream=codec_name,sample_rate,channels,channel_layout -of csv=p=0 "\$file")" = "\$AUDIO_CODEC,\$SAMPLE_RATE,\$channels,\$layout" ]; then
+      copy_args=(-map "0:a:\$stream_index" "\${art_args[@]}" -dn -sn -map_chapters -1 -c:a copy "\${metadata_args[@]}")
+    fi
+
+    converted=0
+    if [ \${#copy_args[@]} -gt 0 ]; then
+      if run_logged ffmpeg -y -i "\$file" "\${copy_args[@]}" "\$work_file"; then
+        converted=1
+        log_msg info "Copied \$AUDIO_CODEC audio from \$file without re-encoding"
       else
-        echo "Error: Failed to convert \$file" >> "\$LOG_FILE"
+        log_msg warn "Could not copy \$AUDIO_CODEC audio from \$file into \$OUTPUT_EXTENSION. Transcoding instead."
       fi
-    else
-      echo "Unsupported file format for \$file. Deleting..." >> "\$LOG_FILE"
+    fi
+    if [ \$converted -eq 1 ]; then
+      true
+    elif run_logged ffmpeg -y -i "\$file" "\${ffmpeg_args[@]}" "\${art_args[@]}" "\$work_file"; then
+      converted=1
+    elif [ "\${art_args[0]}" != "-vn" ] && {
+      log_msg warn "Could not keep the cover art of \$file in \$OUTPUT_EXTENSION. Converting without it."
+      run_logged ffmpeg -y -i "\$file" "\${ffmpeg_args[@]}" -vn "\$work_file"
+    }; then
+      converted=1
+    elif [ "\$ATTEMPT_REPAIR" = "true" ]; then
+      # Remuxing fixes many inputs with bad timestamps or a misplaced index
+      repaired_file="\$(mktemp --suffix="\$extension")"
+      log_msg warn "Conversion of \$file failed. Remuxing to \$repaired_file and retrying..."
+      if run_logged ffmpeg -y -i "\$file" -map 0:a -c copy "\$repaired_file" &&
+        run_logged ffmpeg -y -i "\$repaired_file" "\${ffmpeg_args[@]}" -vn "\$work_file"; then
+        converted=1
+        log_msg info "Converted \$file after repairing it"
+      fi
+      rm -f "\$repaired_file"
+    fi
+    if [ \$converted -eq 1 ] && ! reason="\$(verify_output "\$file" "\$work_file" "\$trimmed")"; then
+      log_msg error "Conversion of \$file produced a bad file: \$reason"
+      last_output="\$reason"
+      converted=0
+    fi
+    if [ \$converted -eq 1 ]; then
+      if [ "\$WRITE_REPLAYGAIN" = "true" ]; then
+        add_replaygain "\$work_file"
+      fi
+      if ! mv -f "\$work_file" "\$target_file"; then
+        last_output="could not rename \$work_file to \$target_file"
+        converted=0
+      fi
+    fi
+    if [ \$converted -eq 1 ]; then
+      rm -f "\$(state_file "\$file" loudnorm)" "\$(state_file "\$file" attempts)"
+      echo "\$hash \$target_file" >> "\$HASH_INDEX"
       rm -f "\$file"
+      log_msg info "Successfully converted \$file to \$target_file"
+    else
+      rm -f "\$work_file"
+      log_msg error "Failed to convert \$file"
+      record_failure "\$file" "\$last_output"
     fi
   else
-    echo "Skipping non-file or missing file: \$file" >> "\$LOG_FILE"
+    log_msg warn "Unsupported file format for \$file. Deleting..."
+    rm -f "\$file"
   fi
+}
 
+files_found=0
+for file in "\$UPLOAD_DIR"/*; do
+  log_msg debug "Checking file: \$file"
+  if [ -f "\$file" ]; then
+    if is_partial_upload "\$file"; then
+      log_msg debug "Skipping partial upload: \$file"
+      continue
+    fi
+    files_found=1
+    if ! has_free_space; then
+      log_msg warn "Less than \$MIN_FREE_DISK_MB MB free in \$MUSIC_DIR. Leaving remaining uploads for a later run."
+      break
+    fi
+    # Each file is dispatched once per run, and the lock stops runs from overlapping
+    while [ "\$(jobs -rp | wc -l)" -ge "\$CONVERTER_WORKERS" ]; do
+      wait -n
+    done
+    process_file "\$file" &
+  else
+    log_msg debug "Skipping non-file or missing file: \$file"
+  fi
 done
+wait
+compact_hash_index
+prune_state
 
 if [ \$files_found -eq 0 ]; then
-  echo "No files found in \$UPLOAD_DIR to process." >> "\$LOG_FILE"
+  log_msg debug "No files found in \$UPLOAD_DIR to process."
 fi
 
-echo "File detection completed at \$(date)" >> "\$LOG_FILE"
+log_msg info "File detection completed"
 EOF
 chmod +x "$CONVERTER_SCRIPT"
 
 # Clean existing crontab for the submit user and set up the new cron job
-echo "Scheduling converter script in cron..." | tee -a "$LOG_FILE"
+echo "Scheduling converter script in cron..." | tee -a "$SETUP_LOG_FILE"
 sudo crontab -u "$SUBMIT_USER" -r 2>/dev/null || true
 {
   echo "* * * * * $CONVERTER_SCRIPT"
 } | sudo crontab -u "$SUBMIT_USER" -
+# Pruning runs as root so fuser can see the file ices2 is playing
+echo "* * * * * root $CONVERTER_SCRIPT --prune" > /etc/cron.d/riverrun_prune
 
 # Generate an M3U playlist file
-echo "Generating M3U file..." | tee -a "$LOG_FILE"
-STREAM_URL="http://$(hostname -I | awk '{print $1}'):8000/stream"
+echo "Generating M3U file..." | tee -a "$SETUP_LOG_FILE"
+STREAM_URL="http://$ICECAST_PUBLIC_ADDRESS:$ICECAST_PORT/stream"
 mkdir -p "$(dirname "$M3U_FILE")"
-echo "$STREAM_URL" > "$M3U_FILE"
-chmod 644 "$M3U_FILE"
+# Write next to the target and rename over it, so clients never read a half-written playlist
+M3U_TMP="$(mktemp "$M3U_FILE.XXXXXX")"
+if [ "$M3U_EXTENDED" = "true" ]; then
+  # A live stream has no fixed length, which EXTINF marks with -1
+  {
+    echo "#EXTM3U"
+    echo "#EXTINF:-1,$ICECAST_STREAM_NAME"
+    echo "$STREAM_URL"
+  } > "$M3U_TMP"
+else
+  echo "$STREAM_URL" > "$M3U_TMP"
+fi
+chmod 644 "$M3U_TMP"
+mv -f "$M3U_TMP" "$M3U_FILE"
 
-echo "An M3U file has been created at $M3U_FILE. Share this file to allow users to connect to the stream." | tee -a "$LOG_FILE"
-echo "Setup complete. Icecast is running, and the upload and conversion system is ready." | tee -a "$LOG_FILE"
-echo "Upload files to $UPLOAD_DIR via SSH as the $SUBMIT_USER user." | tee -a "$LOG_FILE"
-echo "Converted files will be available in $MUSIC_DIR." | tee -a "$LOG_FILE"
+echo "An M3U file has been created at $M3U_FILE. Share this file to allow users to connect to the stream." | tee -a "$SETUP_LOG_FILE"
+echo "Setup complete. Icecast is running, and the upload and conversion system is ready." | tee -a "$SETUP_LOG_FILE"
+echo "Upload files to $UPLOAD_DIR via SSH as the $SUBMIT_USER user." | tee -a "$SETUP_LOG_FILE"
+echo "Converted files will be available in $MUSIC_DIR." | tee -a "$SETUP_LOG_FILE"
@@ -0,0 +1,237 @@
+#!/bin/bash
+
+# Tests for the converter helpers that riverrun_setup.sh writes out. The converter is
+# rendered from the setup script's heredoc and only its functions are sourced, with
+# ffprobe, ffmpeg, fuser, pgrep and sleep replaced by stubs, so no root, media tools
+# or Icecast install is needed. Run from anywhere: ./tests/converter_test.sh
+
+REPO_DIR="$(cd "$(dirname "$0")/.." && pwd)"
+WORK_DIR="$(mktemp -d)"
+trap 'rm -rf "$WORK_DIR"' EXIT
+
+# Stubs, driven by STUB_* variables
+mkdir -p "$WORK_DIR/bin"
+cat > "$WORK_DIR/bin/ffprobe" << 'EOF'
+#!/bin/bash
+echo "$STUB_DURATION"
+EOF
+cat > "$WORK_DIR/bin/ffmpeg" << 'EOF'
+#!/bin/bash
+printf '%b' "$STUB_FFMPEG_OUTPUT" >&2
+exit "${STUB_FFMPEG_STATUS:-0}"
+EOF
+cat > "$WORK_DIR/bin/fuser" << 'EOF'
+#!/bin/bash
+[ -n "$STUB_FILE_IN_USE" ] && [ "$2" = "$STUB_FILE_IN_USE" ]
+EOF
+cat > "$WORK_DIR/bin/pgrep" << 'EOF'
+#!/bin/bash
+[ -n "$STUB_ICES2_PID" ] && echo "$STUB_ICES2_PID"
+EOF
+cat > "$WORK_DIR/bin/sleep" << 'EOF'
+#!/bin/bash
+if [ -n "$STUB_SLEEP_APPEND" ]; then
+  echo more >> "$STUB_SLEEP_APPEND"
+fi
+if [ -n "$STUB_SLEEP_REMOVE" ]; then
+  rm -f "$STUB_SLEEP_REMOVE"
+fi
+EOF
+chmod +x "$WORK_DIR/bin/"*
+export PATH="$WORK_DIR/bin:$PATH"
+
+# Undo the heredoc's escaping as the shell would, then keep only the function definitions
+awk '/^cat << EOF >> "\$CONVERTER_SCRIPT"$/ { body = 1; next } body && /^EOF$/ { exit } body' \
+  "$REPO_DIR/riverrun_setup.sh" | sed 's/\\\([$`\\]\)/\1/g' > "$WORK_DIR/converter.sh"
+{
+  grep '^LOG_LEVELS=' "$WORK_DIR/converter.sh"
+  awk '/^[a-z_]+\(\) \{$/, /^}$/' "$WORK_DIR/converter.sh"
+} > "$WORK_DIR/helpers.sh"
+source "$WORK_DIR/helpers.sh"
+
+LOG_FILE="$WORK_DIR/riverrun.log"
+LOG_LEVEL="debug"
+LOG_FORMAT="text"
+
+failures=0
+
+# Report a test as passed if the rest of the arguments run successfully
+check() {
+  local name="$1"
+  shift
+  if "$@"; then
+    echo "ok - $name"
+  else
+    echo "FAIL - $name"
+    failures=$((failures + 1))
+  fi
+}
+
+# Report a test as passed if the actual value matches the expected one
+check_eq() {
+  local name="$1"
+  local expected="$2"
+  local actual="$3"
+  if [ "$expected" = "$actual" ]; then
+    echo "ok - $name"
+  else
+    echo "FAIL - $name: expected '$expected', got '$actual'"
+    failures=$((failures + 1))
+  fi
+}
+
+# Print the exit status of a command, discarding its output
+status_of() {
+  "$@" > /dev/null
+  echo $?
+}
+
+# Succeed if the log contains the text
+logged() {
+  grep -qF "$1" "$LOG_FILE"
+}
+
+# Start a fresh, empty MUSIC_DIR
+reset_music_dir() {
+  MUSIC_DIR="$WORK_DIR/music"
+  rm -rf "$MUSIC_DIR"
+  mkdir -p "$MUSIC_DIR"
+}
+
+# Create a file of the given size in KB, last modified the given number of days ago
+make_track() {
+  head -c "$(($2 * 1024))" /dev/zero > "$1"
+  touch -d "-$3 days" "$1"
+}
+
+# target_bitrate
+BITRATE="192k"
+MIN_BITRATE_KBPS=64
+MAX_BITRATE_KBPS=320
+TARGET_SIZE_KB=0
+check_eq "target_bitrate uses BITRATE without a target size" "192k" "$(target_bitrate song.flac)"
+TARGET_SIZE_KB=4000
+check_eq "target_bitrate fits the target size" "163k" "$(STUB_DURATION=200 target_bitrate song.flac)"
+check_eq "target_bitrate caps at MAX_BITRATE_KBPS" "320k" "$(STUB_DURATION=10 target_bitrate song.flac)"
+check_eq "target_bitrate floors at MIN_BITRATE_KBPS" "64k" "$(STUB_DURATION=10000 target_bitrate song.flac)"
+: > "$LOG_FILE"
+check_eq "target_bitrate falls back to BITRATE without a duration" "192k" "$(STUB_DURATION=N/A target_bitrate song.flac)"
+check "target_bitrate warns without a duration" logged "Cannot read duration of song.flac for target size"
+
+# is_partial_upload
+PARTIAL_FILE_PATTERNS="*.part *.filepart *.tmp"
+check "is_partial_upload matches an scp temp name" is_partial_upload "/upload/song.flac.part"
+check "is_partial_upload matches an sftp temp name" is_partial_upload "/upload/song.flac.filepart"
+check "is_partial_upload passes a finished upload" eval '! is_partial_upload "/upload/song.flac"'
+check "is_partial_upload only matches the whole name" eval '! is_partial_upload "/upload/song.tmp.flac"'
+
+# upload_ready
+UPLOAD_POLL_INTERVAL_SEC=1
+UPLOAD_STABLE_POLLS=2
+upload="$WORK_DIR/upload.flac"
+echo data > "$upload"
+touch -d "-1 hour" "$upload"
+check_eq "upload_ready accepts a file untouched for the whole window" 0 "$(status_of upload_ready "$upload")"
+check_eq "upload_ready waits while the file is open" 1 "$(STUB_FILE_IN_USE="$upload" status_of upload_ready "$upload")"
+touch "$upload"
+check_eq "upload_ready accepts a recent file once its size holds" 0 "$(status_of upload_ready "$upload")"
+check_eq "upload_ready waits while the file grows" 1 "$(STUB_SLEEP_APPEND="$upload" status_of upload_ready "$upload")"
+check_eq "upload_ready reports a file that disappears" 2 "$(STUB_SLEEP_REMOVE="$upload" status_of upload_ready "$upload")"
+
+# silence_bounds
+SILENCE_THRESHOLD_DB=-50
+SILENCE_MIN_DURATION_SEC=0.5
+export STUB_DURATION=100
+check_eq "silence_bounds trims leading and trailing silence" "2.500 97.000 5.500" \
+  "$(STUB_FFMPEG_OUTPUT='silence_start: 0\nsilence_end: 2.5 | silence_duration: 2.5\nsilence_start: 97\nsilence_end: 100 | silence_duration: 3\n' \
+    silence_bounds song.flac 0)"
+check_eq "silence_bounds trims silence that runs to the end without a silence_end" "1.500 98.000 3.500" \
+  "$(STUB_FFMPEG_OUTPUT='silence_start: 0\nsilence_end: 1.5 | silence_duration: 1.5\nsilence_start: 98\n' \
+    silence_bounds song.flac 0)"
+check "silence_bounds leaves silence in the middle of a track" eval \
+  '! STUB_FFMPEG_OUTPUT="silence_start: 40\nsilence_end: 42 | silence_duration: 2\n" silence_bounds song.flac 0 > /dev/null'
+check "silence_bounds fails without a duration" eval '! STUB_DURATION= silence_bounds song.flac 0 > /dev/null'
+check "silence_bounds fails when detection fails" eval '! STUB_FFMPEG_STATUS=1 silence_bounds song.flac 0 > /dev/null'
+unset STUB_DURATION
+
+# prune_library
+MAX_LIBRARY_MB=0
+MAX_LIBRARY_FILES=0
+MAX_LIBRARY_AGE_DAYS=0
+reset_music_dir
+make_track "$MUSIC_DIR/old.ogg" 1 3
+make_track "$MUSIC_DIR/middle.ogg" 1 2
+make_track "$MUSIC_DIR/new.ogg" 1 1
+prune_library
+check_eq "prune_library does nothing with every limit disabled" 3 "$(ls "$MUSIC_DIR" | wc -l)"
+MAX_LIBRARY_FILES=2
+prune_library
+check_eq "prune_library removes the oldest file over MAX_LIBRARY_FILES" "middle.ogg new.ogg" "$(ls -tr "$MUSIC_DIR" | xargs)"
+MAX_LIBRARY_FILES=1
+STUB_FILE_IN_USE="$MUSIC_DIR/middle.ogg" prune_library
+check_eq "prune_library skips a file that is in use" "middle.ogg" "$(ls "$MUSIC_DIR" | xargs)"
+reset_music_dir
+make_track "$MUSIC_DIR/old.ogg" 1 3
+make_track "$MUSIC_DIR/new.ogg" 1 1
+STUB_ICES2_PID=999999999 prune_library
+check_eq "prune_library skips everything while an ices2 process can't be inspected" 2 "$(ls "$MUSIC_DIR" | wc -l)"
+make_track "$MUSIC_DIR/.converting.ogg" 1 5
+MAX_LIBRARY_FILES=2
+prune_library
+check_eq "prune_library ignores hidden in-progress conversions" 3 "$(ls -A "$MUSIC_DIR" | wc -l)"
+MAX_LIBRARY_FILES=0
+MAX_LIBRARY_AGE_DAYS=2
+prune_library
+check_eq "prune_library removes files older than MAX_LIBRARY_AGE_DAYS" ".converting.ogg new.ogg" "$(ls -A "$MUSIC_DIR" | xargs)"
+MAX_LIBRARY_AGE_DAYS=0
+MAX_LIBRARY_MB=1
+reset_music_dir
+make_track "$MUSIC_DIR/old.ogg" 600 2
+make_track "$MUSIC_DIR/new.ogg" 600 1
+prune_library
+check_eq "prune_library removes the oldest file over MAX_LIBRARY_MB" "new.ogg" "$(ls "$MUSIC_DIR" | xargs)"
+MAX_LIBRARY_MB=0
+
+# rotate_log
+LOG_MAX_SIZE_KB=1
+LOG_RETAIN=2
+rm -f "$LOG_FILE"*
+echo small > "$LOG_FILE"
+rotate_log
+check "rotate_log leaves a log under LOG_MAX_SIZE_KB" eval '[ ! -e "$LOG_FILE.1" ]'
+head -c 2048 /dev/zero > "$LOG_FILE"
+echo previous > "$LOG_FILE.1"
+rotate_log
+check_eq "rotate_log moves the log to .1" 2048 "$(stat -c %s "$LOG_FILE.1")"
+check_eq "rotate_log moves .1 to .2" previous "$(cat "$LOG_FILE.2")"
+check "rotate_log starts a fresh log" eval '[ ! -s "$LOG_FILE" ]'
+LOG_RETAIN=0
+head -c 2048 /dev/zero > "$LOG_FILE"
+rotate_log
+check_eq "rotate_log truncates the log when LOG_RETAIN is 0" 0 "$(stat -c %s "$LOG_FILE")"
+LOG_RETAIN=2
+rm -f "$LOG_FILE"*
+mkdir "$LOG_FILE.2"
+head -c 2048 /dev/zero > "$LOG_FILE"
+rotate_log
+check "rotate_log warns when rotation fails" logged "Could not rotate $LOG_FILE at 2 KB"
+rmdir "$LOG_FILE.2"
+if [ "$EUID" -ne 0 ]; then
+  # Root can write to any directory, so this case only runs as another user
+  rm -f "$LOG_FILE"*
+  head -c 2048 /dev/zero > "$LOG_FILE"
+  touch "$LOG_FILE.1" "$LOG_FILE.2"
+  chmod a-w "$WORK_DIR"
+  rotate_log
+  chmod u+w "$WORK_DIR"
+  check_eq "rotate_log copies and truncates without a writable directory" "2048 0" \
+    "$(stat -c %s "$LOG_FILE.1") $(stat -c %s "$LOG_FILE")"
+else
+  echo "skip - rotate_log copy and truncate needs a non-root user"
+fi
+
+if [ "$failures" -gt 0 ]; then
+  echo "$failures test(s) failed"
+  exit 1
+fi
+echo "All tests passed"